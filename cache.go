@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zmb3/spotify"
+)
+
+// cache is the lookup layer shared by the Spotify and IBL/Playlister
+// fetchers. Implementations only need to store and retrieve opaque,
+// already-marshalled JSON blobs keyed by string - that's enough to back
+// either a local SQLite file (the default) or a shared store like Redis.
+type cache interface {
+	get(ctx context.Context, key string) ([]byte, bool, error)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// sqliteCache is the default cache backend: a single table in a local
+// SQLite file, good enough for a single instance of the service.
+type sqliteCache struct {
+	db *sql.DB
+}
+
+func newSQLiteCache(path string) (*sqliteCache, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache database: %w", err)
+	}
+	// SQLite allows only one writer at a time; serialise access through a
+	// single connection rather than letting concurrent callers (the
+	// spotifyAnalysisConcurrency worker pool, for example) race for the
+	// write lock and fail with "database is locked".
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cache_entries (
+			key TEXT PRIMARY KEY,
+			value BLOB NOT NULL,
+			expires_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise cache schema: %w", err)
+	}
+
+	return &sqliteCache{db: db}, nil
+}
+
+func (c *sqliteCache) get(ctx context.Context, key string) ([]byte, bool, error) {
+	var value []byte
+	var expiresAt int64
+	row := c.db.QueryRowContext(ctx, `SELECT value, expires_at FROM cache_entries WHERE key = ?`, key)
+	err := row.Scan(&value, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if time.Now().Unix() > expiresAt {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+func (c *sqliteCache) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO cache_entries (key, value, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+	`, key, value, time.Now().Add(ttl).Unix())
+	return err
+}
+
+func (c *sqliteCache) Close() error {
+	return c.db.Close()
+}
+
+// The TTLs below are deliberately generous: audio features/analysis never
+// change for a given track ID, and episode/version/record mappings change
+// on the BBC's publishing cadence rather than ours.
+const (
+	audioFeaturesTTL = 30 * 24 * time.Hour
+	audioAnalysisTTL = 30 * 24 * time.Hour
+	versionIDTTL     = time.Hour
+	recordIDsTTL     = time.Hour
+	externalLinksTTL = time.Hour
+)
+
+func audioFeaturesCacheKey(trackID spotify.ID) string {
+	return fmt.Sprintf("features:%s", trackID)
+}
+
+func audioAnalysisCacheKey(trackID spotify.ID) string {
+	return fmt.Sprintf("analysis:%s", trackID)
+}
+
+func versionIDCacheKey(episodeID string) string {
+	return fmt.Sprintf("version:%s", episodeID)
+}
+
+func recordIDsCacheKey(versionID string) string {
+	return fmt.Sprintf("records:%s", versionID)
+}
+
+func externalLinksCacheKey(recordID string) string {
+	return fmt.Sprintf("links:%s", recordID)
+}
+
+// getJSON is a small helper that looks up key, unmarshals it into dest if
+// present, and reports whether it was found.
+func getJSON(ctx context.Context, c cache, key string, dest interface{}) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	value, ok, err := c.get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := json.Unmarshal(value, dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func setJSON(ctx context.Context, c cache, key string, ttl time.Duration, value interface{}) error {
+	if c == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.set(ctx, key, data, ttl)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteCache(t *testing.T) *sqliteCache {
+	t.Helper()
+	c, err := newSQLiteCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("newSQLiteCache: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSQLiteCacheGetSet(t *testing.T) {
+	c := newTestSQLiteCache(t)
+	ctx := context.Background()
+
+	if _, found, err := c.get(ctx, "missing"); err != nil || found {
+		t.Fatalf("get(missing) = found %v, err %v; want not found, nil", found, err)
+	}
+
+	if err := c.set(ctx, "key", []byte("value"), time.Hour); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	value, found, err := c.get(ctx, "key")
+	if err != nil || !found {
+		t.Fatalf("get(key) = found %v, err %v; want found, nil", found, err)
+	}
+	if string(value) != "value" {
+		t.Fatalf("value = %q, want %q", value, "value")
+	}
+}
+
+func TestSQLiteCacheOverwrite(t *testing.T) {
+	c := newTestSQLiteCache(t)
+	ctx := context.Background()
+
+	if err := c.set(ctx, "key", []byte("first"), time.Hour); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := c.set(ctx, "key", []byte("second"), time.Hour); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	value, found, err := c.get(ctx, "key")
+	if err != nil || !found {
+		t.Fatalf("get(key) = found %v, err %v; want found, nil", found, err)
+	}
+	if string(value) != "second" {
+		t.Fatalf("value = %q, want %q", value, "second")
+	}
+}
+
+func TestSQLiteCacheExpiry(t *testing.T) {
+	c := newTestSQLiteCache(t)
+	ctx := context.Background()
+
+	if err := c.set(ctx, "key", []byte("value"), -time.Second); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	if _, found, err := c.get(ctx, "key"); err != nil || found {
+		t.Fatalf("get(key) = found %v, err %v; want expired entries not found", found, err)
+	}
+}
+
+func TestGetSetJSONRoundTrip(t *testing.T) {
+	c := newTestSQLiteCache(t)
+	ctx := context.Background()
+
+	type payload struct {
+		Name string `json:"name"`
+	}
+
+	if err := setJSON(ctx, c, "key", time.Hour, payload{Name: "episode"}); err != nil {
+		t.Fatalf("setJSON: %v", err)
+	}
+
+	var got payload
+	found, err := getJSON(ctx, c, "key", &got)
+	if err != nil || !found {
+		t.Fatalf("getJSON = found %v, err %v; want found, nil", found, err)
+	}
+	if got.Name != "episode" {
+		t.Fatalf("got.Name = %q, want %q", got.Name, "episode")
+	}
+}
+
+func TestGetSetJSONNilCache(t *testing.T) {
+	ctx := context.Background()
+
+	if err := setJSON(ctx, nil, "key", time.Hour, "value"); err != nil {
+		t.Fatalf("setJSON with nil cache should be a no-op, got error: %v", err)
+	}
+
+	var got string
+	found, err := getJSON(ctx, nil, "key", &got)
+	if err != nil || found {
+		t.Fatalf("getJSON with nil cache = found %v, err %v; want not found, nil", found, err)
+	}
+}
@@ -5,17 +5,22 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tkanos/gonfig"
 	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
@@ -27,8 +32,26 @@ type configuration struct {
 	MusicURL            string `json:"musicUrl"`
 	IBLUrl              string `json:"iblUrl"`
 	PlaylisterURL       string `json:"playlisterUrl"`
+	ListenAddr          string `json:"listenAddr"`
+	CachePath           string `json:"cachePath"`
+
+	// Providers lists the non-Spotify external-link types to dispatch to a
+	// moodProvider, e.g. ["MUSICBRAINZ"]. Spotify is always handled.
+	Providers                  []string `json:"providers"`
+	AcousticBrainzHighLevelURL string   `json:"acousticBrainzHighLevelUrl"`
+	AcousticBrainzLowLevelURL  string   `json:"acousticBrainzLowLevelUrl"`
+
+	// InsecureSkipVerify disables Music API server certificate verification.
+	// It's a dev-only opt-in, never the default.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
 }
 
+// upstreamClientTimeout bounds how long a single call to any upstream HTTP
+// dependency (IBL, Playlister, Music API, AcousticBrainz) may take, so a
+// hung upstream can't block a request indefinitely in this long-running
+// service.
+const upstreamClientTimeout = 10 * time.Second
+
 type errorMessage struct {
 	Error string `json:"error"`
 }
@@ -71,11 +94,53 @@ type spotifyTrackData struct {
 	Analysis spotify.AudioAnalysis
 }
 
+// mood is the full feature vector for an episode, derived from the Russell
+// valence-arousal model plus the rest of what Spotify's audio-features and
+// audio-analysis endpoints expose. Label is the valence-arousal quadrant
+// ("happy", "tense", "sad", "calm"); Segments is a mood timeline built from
+// each track's analysis sections, in episode order, for providers that
+// expose segment-level data.
 type mood struct {
-	ChillFactor     float32 `json:"chillFactor"`
-	HappinessFactor float32 `json:"happinessFactor"`
+	Valence          float32       `json:"valence"`
+	Arousal          float32       `json:"arousal"`
+	Danceability     float32       `json:"danceability"`
+	Acousticness     float32       `json:"acousticness"`
+	Instrumentalness float32       `json:"instrumentalness"`
+	Speechiness      float32       `json:"speechiness"`
+	Key              int           `json:"key"`
+	Mode             int           `json:"mode"`
+	Tempo            float32       `json:"tempo"`
+	TempoConfidence  float32       `json:"tempoConfidence"`
+	Label            string        `json:"label"`
+	Segments         []segmentMood `json:"segments,omitempty"`
+}
+
+// segmentMood is one entry in the episode's mood timeline, covering a
+// single analysis section of one track.
+type segmentMood struct {
+	StartSeconds    float32 `json:"startSeconds"`
+	DurationSeconds float32 `json:"durationSeconds"`
+	Arousal         float32 `json:"arousal"`
+	Label           string  `json:"label"`
+}
+
+// app holds everything that can be set up once at startup and reused across
+// requests: configuration, the HTTP clients used for IBL/Playlister and
+// Music API calls, and an authenticated Spotify client.
+type app struct {
+	config        configuration
+	httpClient    *http.Client
+	musicClient   *http.Client
+	spotifyClient spotify.Client
+	cache         cache
+	providers     map[string]moodProvider
 }
 
+var (
+	requestsTotal = expvar.NewInt("requestsTotal")
+	requestErrors = expvar.NewInt("requestErrors")
+)
+
 func getConfiguration() configuration {
 	configuration := configuration{}
 	err := gonfig.GetConf("./config.json", &configuration)
@@ -88,7 +153,15 @@ func getConfiguration() configuration {
 	for i := 0; i < v.NumField(); i++ {
 		values[i] = v.Field(i).Interface()
 	}
-	for _, val := range values {
+	for i, val := range values {
+		// ListenAddr, CachePath, the provider settings and the Music API TLS
+		// settings are optional; everything else must be set.
+		fieldName := v.Type().Field(i).Name
+		switch fieldName {
+		case "ListenAddr", "CachePath", "Providers", "AcousticBrainzHighLevelURL", "AcousticBrainzLowLevelURL",
+			"CertFile", "KeyFile", "InsecureSkipVerify":
+			continue
+		}
 		strVal := fmt.Sprintln(val)
 		if !(len(strVal) > 1) {
 			returnError("Config incomplete")
@@ -97,39 +170,108 @@ func getConfiguration() configuration {
 	return configuration
 }
 
-func getRecordIDs(versionID string) []string {
-	configuration := getConfiguration()
-	url := fmt.Sprintf(configuration.PlaylisterURL, versionID)
+// newApp builds an app from configuration, authenticating against Spotify
+// once so the resulting client and token can be reused across requests.
+func newApp(ctx context.Context, config configuration) (*app, error) {
+	clientCredentialsConfig := &clientcredentials.Config{
+		ClientID:     config.SpotifyClientID,
+		ClientSecret: config.SpotifyClientSecret,
+		TokenURL:     spotify.TokenURL,
+	}
+	tokenSource := clientCredentialsConfig.TokenSource(ctx)
+	_, err := tokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get Spotify token: %w", err)
+	}
 
-	res := playlisterResponse{}
-	httpRes, err := http.Get(url)
+	cachePath := config.CachePath
+	if cachePath == "" {
+		cachePath = "cache.db"
+	}
+	appCache, err := newSQLiteCache(cachePath)
 	if err != nil {
-		returnError("Failed to get Record IDs")
+		return nil, err
 	}
-	body, _ := ioutil.ReadAll(httpRes.Body)
 
-	json.Unmarshal(body, &res)
+	spotifyHTTPClient := oauth2.NewClient(ctx, tokenSource)
+	spotifyHTTPClient.Transport = &retryTransport{
+		base:       spotifyHTTPClient.Transport,
+		maxRetries: retryTransportMaxRetries,
+		baseDelay:  retryTransportBaseDelay,
+	}
+
+	httpClient := &http.Client{Timeout: upstreamClientTimeout}
+
+	musicClient, err := buildMusicHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app{
+		config:        config,
+		httpClient:    httpClient,
+		musicClient:   musicClient,
+		spotifyClient: spotify.NewClient(spotifyHTTPClient),
+		cache:         appCache,
+		providers:     buildProviders(config, httpClient),
+	}, nil
+}
 
+func (a *app) getRecordIDs(ctx context.Context, versionID string) ([]string, error) {
+	cacheKey := recordIDsCacheKey(versionID)
 	var recordIds []string
+	if found, err := getJSON(ctx, a.cache, cacheKey, &recordIds); err == nil && found {
+		return recordIds, nil
+	}
+
+	url := fmt.Sprintf(a.config.PlaylisterURL, versionID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpRes, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get record IDs: %w", err)
+	}
+	defer httpRes.Body.Close()
+	body, _ := ioutil.ReadAll(httpRes.Body)
+
+	res := playlisterResponse{}
+	json.Unmarshal(body, &res)
 
 	for _, segment := range res.Segments {
 		recordIds = append(recordIds, segment.RecordID)
 	}
 
-	return recordIds
+	if err := setJSON(ctx, a.cache, cacheKey, recordIDsTTL, recordIds); err != nil {
+		log.Printf("failed to cache record IDs for %s: %v", versionID, err)
+	}
+
+	return recordIds, nil
 }
 
-func getVersionID(episodeID string) (string, error) {
-	configuration := getConfiguration()
-	url := fmt.Sprintf(configuration.IBLUrl, episodeID)
+func (a *app) getVersionID(ctx context.Context, episodeID string) (string, error) {
+	cacheKey := versionIDCacheKey(episodeID)
+	var versionID string
+	if found, err := getJSON(ctx, a.cache, cacheKey, &versionID); err == nil && found {
+		return versionID, nil
+	}
 
-	epResp1 := iblEpisodesResponse{}
-	res, err := http.Get(url)
+	url := fmt.Sprintf(a.config.IBLUrl, episodeID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := a.httpClient.Do(req)
 	if err != nil {
-		returnError("Failed to get Episode Information")
+		return "", fmt.Errorf("failed to get episode information: %w", err)
 	}
+	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 
+	epResp1 := iblEpisodesResponse{}
 	json.Unmarshal(body, &epResp1)
 
 	if len(epResp1.Episodes) < 1 {
@@ -138,95 +280,279 @@ func getVersionID(episodeID string) (string, error) {
 	if len(epResp1.Episodes[0].Versions) < 1 {
 		return "nil", errors.New("No Version available")
 	}
-	return epResp1.Episodes[0].Versions[0].ID, nil
-}
+	versionID = epResp1.Episodes[0].Versions[0].ID
 
-func getExternalLinks(recordID string) []externalLink {
-	configuration := getConfiguration()
-	url := fmt.Sprintf(configuration.MusicURL, recordID)
-	cert, err := tls.LoadX509KeyPair(configuration.CertFile, configuration.KeyFile)
-	if err != nil {
-		log.Fatal(err)
+	if err := setJSON(ctx, a.cache, cacheKey, versionIDTTL, versionID); err != nil {
+		log.Printf("failed to cache version ID for %s: %v", episodeID, err)
 	}
 
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+	return versionID, nil
+}
+
+func (a *app) getExternalLinks(ctx context.Context, recordID string) ([]externalLink, error) {
+	cacheKey := externalLinksCacheKey(recordID)
+	var links []externalLink
+	if found, err := getJSON(ctx, a.cache, cacheKey, &links); err == nil && found {
+		return links, nil
 	}
-	tlsConfig.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
-	client := &http.Client{Transport: transport}
 
-	musResp1 := musicResponse{}
-	res, err := client.Get(url)
+	url := fmt.Sprintf(a.config.MusicURL, recordID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.musicClient.Do(req)
 	if err != nil {
-		returnError("Failed to get External Links")
+		return nil, fmt.Errorf("failed to get external links: %w", err)
 	}
+	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 
+	musResp1 := musicResponse{}
 	json.Unmarshal(body, &musResp1)
-	return musResp1.Data.ExternalLinks
+	links = musResp1.Data.ExternalLinks
+
+	if err := setJSON(ctx, a.cache, cacheKey, externalLinksTTL, links); err != nil {
+		log.Printf("failed to cache external links for %s: %v", recordID, err)
+	}
+
+	return links, nil
 }
 
-func getSpotifyData(trackIDs []spotify.ID) []spotifyTrackData {
-	configuration := getConfiguration()
-	config := &clientcredentials.Config{
-		ClientID:     configuration.SpotifyClientID,
-		ClientSecret: configuration.SpotifyClientSecret,
-		TokenURL:     spotify.TokenURL,
+// buildMusicHTTPClient builds the shared client used for every Music API
+// call. Mutual TLS only kicks in when both CertFile and KeyFile are set;
+// otherwise this is a plain TLS client with normal CA verification, unless
+// InsecureSkipVerify opts out of that for local development.
+func buildMusicHTTPClient(config configuration) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
 	}
 
-	token, err := config.Token(context.Background())
-	if err != nil {
-		returnError(fmt.Sprintf("couldn't get token: %v", err))
+	if config.CertFile != "" && config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load music API client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
-	client := spotify.Authenticator{}.NewClient(token)
 
-	var tracks []spotifyTrackData
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   upstreamClientTimeout,
+	}, nil
+}
 
-	for _, trackID := range trackIDs {
-		featurePointer, _ := client.GetAudioFeatures(trackID)
-		analysisPointer, _ := client.GetAudioAnalysis(trackID)
+// getMood averages the feature vectors of every track in the episode and
+// classifies the result into a valence-arousal quadrant. The per-track
+// analysis sections (if any) are concatenated in order into an episode-wide
+// mood timeline.
+func getMood(tracks []trackFeatures) mood {
+	var totalValence, totalArousal, totalDanceability float32
+	var totalAcousticness, totalInstrumentalness, totalSpeechiness float32
+	var totalTempo, totalTempoConfidence float32
+	var keys, modes []int
+	var segments []segmentMood
+	var offset float32
 
-		track := spotifyTrackData{
-			Analysis: *analysisPointer,
-			Features: *featurePointer[0],
+	for _, track := range tracks {
+		totalValence += track.Valence
+		totalArousal += track.Energy
+		totalDanceability += track.Danceability
+		totalAcousticness += track.Acousticness
+		totalInstrumentalness += track.Instrumentalness
+		totalSpeechiness += track.Speechiness
+		totalTempo += track.Tempo
+		totalTempoConfidence += track.TempoConfidence
+		keys = append(keys, track.Key)
+		modes = append(modes, track.Mode)
+
+		for _, segment := range track.Segments {
+			segments = append(segments, segmentMood{
+				StartSeconds:    offset + segment.StartSeconds,
+				DurationSeconds: segment.DurationSeconds,
+				Arousal:         segment.Arousal,
+				Label:           segment.Label,
+			})
 		}
+		offset += track.Duration
+	}
 
-		tracks = append(tracks, track)
+	n := float32(len(tracks))
+	valence := totalValence / n
+	arousal := totalArousal / n
+
+	return mood{
+		Valence:          valence,
+		Arousal:          arousal,
+		Danceability:     totalDanceability / n,
+		Acousticness:     totalAcousticness / n,
+		Instrumentalness: totalInstrumentalness / n,
+		Speechiness:      totalSpeechiness / n,
+		Key:              dominantInt(keys),
+		Mode:             dominantInt(modes),
+		Tempo:            totalTempo / n,
+		TempoConfidence:  totalTempoConfidence / n,
+		Label:            moodLabel(valence, arousal),
+		Segments:         segments,
 	}
+}
 
-	return tracks
+// moodLabel classifies a valence-arousal pair into one of Russell's four
+// quadrants, splitting both axes at their midpoint (0.5).
+func moodLabel(valence, arousal float32) string {
+	switch {
+	case valence >= 0.5 && arousal >= 0.5:
+		return "happy"
+	case valence < 0.5 && arousal >= 0.5:
+		return "tense"
+	case valence < 0.5 && arousal < 0.5:
+		return "sad"
+	default:
+		return "calm"
+	}
 }
 
-func getMood(tracks []spotifyTrackData) mood {
-	var moods []mood
+// dominantInt returns the most frequent value, e.g. the dominant key or
+// mode across the tracks in an episode. Ties resolve to whichever value was
+// seen first.
+func dominantInt(values []int) int {
+	counts := make(map[int]int, len(values))
+	firstSeen := make(map[int]int, len(values))
+	for i, v := range values {
+		counts[v]++
+		if _, ok := firstSeen[v]; !ok {
+			firstSeen[v] = i
+		}
+	}
 
-	for _, track := range tracks {
-		trackAnalysis := track.Analysis.Track
-		trackFeatures := track.Features
+	best, bestCount, bestFirstSeen := 0, -1, -1
+	for v, count := range counts {
+		if count > bestCount || (count == bestCount && firstSeen[v] < bestFirstSeen) {
+			best, bestCount, bestFirstSeen = v, count, firstSeen[v]
+		}
+	}
+	return best
+}
 
-		happiness := 5 * (trackFeatures.Valence - 0.5) * (trackFeatures.Danceability * trackFeatures.Energy * trackFeatures.Liveness)
-		chillFactor := (float32(trackAnalysis.Tempo) / 120) * ((trackFeatures.Loudness + 30) / 30)
+// getMoodForEpisode runs the full IBL -> Playlister -> Music -> provider
+// pipeline for a single episode ID. Spotify links are batched across the
+// whole episode via getSpotifyData; links of other types are dispatched to
+// whichever moodProvider is configured for them. When a record carries
+// links for more than one provider, their features are averaged into a
+// single data point for that record.
+func (a *app) getMoodForEpisode(ctx context.Context, episodeID string) (mood, error) {
+	versionID, err := a.getVersionID(ctx, episodeID)
+	if err != nil {
+		return mood{}, err
+	}
+	recordIDs, err := a.getRecordIDs(ctx, versionID)
+	if err != nil {
+		return mood{}, err
+	}
+
+	linksByRecord := make(map[string][]externalLink, len(recordIDs))
+	for _, recordID := range recordIDs {
+		links, err := a.getExternalLinks(ctx, recordID)
+		if err != nil {
+			return mood{}, err
+		}
+		linksByRecord[recordID] = links
+	}
 
-		moods = append(moods, mood{
-			HappinessFactor: happiness,
-			ChillFactor:     chillFactor,
-		})
+	spotifyIDByRecord := make(map[string]spotify.ID)
+	var spotifyIDs []spotify.ID
+	for _, recordID := range recordIDs {
+		for _, link := range linksByRecord[recordID] {
+			if link.Type != "SPOTIFY" {
+				continue
+			}
+			segments := strings.Split(link.Value, ":")
+			if len(segments) < 3 {
+				continue
+			}
+			trackID := spotify.ID(segments[2])
+			spotifyIDByRecord[recordID] = trackID
+			spotifyIDs = append(spotifyIDs, trackID)
+		}
 	}
-	var totalHappiness, totalChillFactor float32 = 0, 0
 
-	for _, mood := range moods {
-		totalHappiness = totalHappiness + mood.HappinessFactor
-		totalChillFactor = totalChillFactor + mood.ChillFactor
+	spotifyTracks, err := a.getSpotifyData(ctx, spotifyIDs)
+	if err != nil {
+		return mood{}, err
+	}
+	spotifyFeaturesByID := make(map[spotify.ID]trackFeatures, len(spotifyIDs))
+	for i, trackID := range spotifyIDs {
+		spotifyFeaturesByID[trackID] = featuresFromSpotify(spotifyTracks[i])
 	}
 
-	totalMoods := float32(len(moods))
+	var episodeFeatures []trackFeatures
+	for _, recordID := range recordIDs {
+		var recordFeatures []trackFeatures
 
-	return mood{
-		HappinessFactor: totalHappiness / totalMoods,
-		ChillFactor:     totalChillFactor / totalMoods,
+		if trackID, ok := spotifyIDByRecord[recordID]; ok {
+			recordFeatures = append(recordFeatures, spotifyFeaturesByID[trackID])
+		}
+
+		for _, link := range linksByRecord[recordID] {
+			if link.Type == "SPOTIFY" {
+				continue
+			}
+			provider, ok := a.providers[link.Type]
+			if !ok {
+				log.Printf("no mood provider configured for external link type %q, skipping", link.Type)
+				continue
+			}
+			features, err := provider.Lookup(ctx, link)
+			if err != nil {
+				log.Printf("failed to look up mood via %s for record %s: %v", link.Type, recordID, err)
+				continue
+			}
+			recordFeatures = append(recordFeatures, features)
+		}
+
+		if len(recordFeatures) == 0 {
+			continue
+		}
+		episodeFeatures = append(episodeFeatures, averageTrackFeatures(recordFeatures))
+	}
+
+	episodeMood := getMood(episodeFeatures)
+	if math.IsNaN(float64(episodeMood.Valence)) {
+		return mood{}, errors.New("No mood data available")
+	}
+
+	return episodeMood, nil
+}
+
+func (a *app) handleMood(w http.ResponseWriter, r *http.Request) {
+	requestsTotal.Add(1)
+	episodeID := strings.TrimPrefix(r.URL.Path, "/mood/")
+	if episodeID == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing episode ID")
+		return
+	}
+
+	episodeMood, err := a.getMoodForEpisode(r.Context(), episodeID)
+	if err != nil {
+		requestErrors.Add(1)
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(episodeMood)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorMessage{Error: message})
 }
 
 func returnError(message string) {
@@ -239,40 +565,45 @@ func returnError(message string) {
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		returnError("Invalid number of arguments")
-	}
-	episodeID := os.Args[1]
-	versionID, err := getVersionID(episodeID)
+	config := getConfiguration()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a, err := newApp(ctx, config)
 	if err != nil {
 		returnError(err.Error())
 	}
-	recordIDs := getRecordIDs(versionID)
 
-	var externalLinks []externalLink
-	for _, recordID := range recordIDs {
-		externalLinksForRecord := getExternalLinks(recordID)
-		for _, externalLink := range externalLinksForRecord {
-			externalLinks = append(externalLinks, externalLink)
-		}
+	addr := config.ListenAddr
+	if addr == "" {
+		addr = ":8080"
 	}
 
-	var spotifyIDs []spotify.ID
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.Handle("/metrics", expvar.Handler())
+	mux.HandleFunc("/mood/", a.handleMood)
 
-	for _, externalLink := range externalLinks {
-		if externalLink.Type == "SPOTIFY" {
-			spotifyIDSegments := strings.Split(externalLink.Value, ":")
-			spotifyTrackID := spotifyIDSegments[2]
-			spotifyIDs = append(spotifyIDs, spotify.ID(spotifyTrackID))
-		}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
 	}
 
-	spotifyFeatures := getSpotifyData(spotifyIDs)
-	mood := getMood(spotifyFeatures)
-	moodJSON, _ := json.Marshal(mood)
+	go func() {
+		log.Printf("listening on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("shutting down")
 
-	if math.IsNaN(float64(mood.ChillFactor)) {
-		returnError("No mood data available")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown failed: %v", err)
 	}
-	fmt.Println(string(moodJSON))
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"testing"
 
 	gock "gopkg.in/h2non/gock.v1"
@@ -9,11 +11,16 @@ import (
 func TestGetVersionID(t *testing.T) {
 	defer gock.Off() // Flush pending mocks after test execution
 	gock.New("http://ibl.api.bbci.co.uk").
-		Get("/ibl/v1/episodes/epid1?availability=all\u0026mixin=live").
+		Get("/ibl/v1/episodes/epid1?availability=all&mixin=live").
 		Reply(200).
 		File("fixtures/episode.json")
 
-	versionID, err := getVersionID("epid1")
+	a := &app{
+		config:     configuration{IBLUrl: "http://ibl.api.bbci.co.uk/ibl/v1/episodes/%s?availability=all&mixin=live"},
+		httpClient: &http.Client{},
+	}
+
+	versionID, err := a.getVersionID(context.Background(), "epid1")
 	if err != nil {
 		t.Fail()
 	}
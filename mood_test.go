@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+const floatEpsilon = 1e-6
+
+func floatsEqual(a, b float32) bool {
+	return math.Abs(float64(a-b)) < floatEpsilon
+}
+
+func TestMoodLabelQuadrants(t *testing.T) {
+	tests := []struct {
+		name             string
+		valence, arousal float32
+		want             string
+	}{
+		{"high valence, high arousal", 0.5, 0.5, "happy"},
+		{"low valence, high arousal", 0.49, 0.5, "tense"},
+		{"low valence, low arousal", 0.49, 0.49, "sad"},
+		{"high valence, low arousal", 0.5, 0.49, "calm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := moodLabel(tt.valence, tt.arousal); got != tt.want {
+				t.Fatalf("moodLabel(%v, %v) = %q, want %q", tt.valence, tt.arousal, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDominantIntTieBreakIsFirstSeen(t *testing.T) {
+	// 2 and 5 both occur twice; 2 is seen first, so it should win the tie.
+	values := []int{2, 5, 5, 2}
+
+	if got, want := dominantInt(values), 2; got != want {
+		t.Fatalf("dominantInt(%v) = %v, want %v", values, got, want)
+	}
+}
+
+func TestDominantIntMajorityWins(t *testing.T) {
+	values := []int{1, 3, 3, 3, 1}
+
+	if got, want := dominantInt(values), 3; got != want {
+		t.Fatalf("dominantInt(%v) = %v, want %v", values, got, want)
+	}
+}
+
+func TestDominantIntEmpty(t *testing.T) {
+	if got, want := dominantInt(nil), 0; got != want {
+		t.Fatalf("dominantInt(nil) = %v, want %v", got, want)
+	}
+}
+
+func TestGetMoodAveragesAndClassifies(t *testing.T) {
+	tracks := []trackFeatures{
+		{Valence: 0.8, Energy: 0.8, Danceability: 0.6, Key: 0, Mode: 1, Duration: 100,
+			Segments: []segmentMood{{StartSeconds: 0, DurationSeconds: 10, Arousal: 0.8, Label: "happy"}}},
+		{Valence: 0.6, Energy: 0.6, Danceability: 0.4, Key: 0, Mode: 1, Duration: 50,
+			Segments: []segmentMood{{StartSeconds: 0, DurationSeconds: 5, Arousal: 0.6, Label: "happy"}}},
+	}
+
+	got := getMood(tracks)
+
+	if want := float32(0.7); !floatsEqual(got.Valence, want) {
+		t.Fatalf("Valence = %v, want %v", got.Valence, want)
+	}
+	if want := float32(0.7); !floatsEqual(got.Arousal, want) {
+		t.Fatalf("Arousal = %v, want %v", got.Arousal, want)
+	}
+	if want := "happy"; got.Label != want {
+		t.Fatalf("Label = %q, want %q", got.Label, want)
+	}
+	if want := 0; got.Key != want {
+		t.Fatalf("Key = %v, want %v", got.Key, want)
+	}
+
+	// The second track's segment is offset by the first track's duration.
+	if len(got.Segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(got.Segments))
+	}
+	if want := float32(0); got.Segments[0].StartSeconds != want {
+		t.Fatalf("Segments[0].StartSeconds = %v, want %v", got.Segments[0].StartSeconds, want)
+	}
+	if want := float32(100); got.Segments[1].StartSeconds != want {
+		t.Fatalf("Segments[1].StartSeconds = %v, want %v", got.Segments[1].StartSeconds, want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetExternalLinksPlainTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"external-links":[{"type":"SPOTIFY","value":"spotify:track:abc"}]}}`))
+	}))
+	defer server.Close()
+
+	config := configuration{MusicURL: server.URL + "/music/%s", InsecureSkipVerify: true}
+	musicClient, err := buildMusicHTTPClient(config)
+	if err != nil {
+		t.Fatalf("buildMusicHTTPClient: %v", err)
+	}
+	a := &app{config: config, musicClient: musicClient}
+
+	links, err := a.getExternalLinks(context.Background(), "rec1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(links) != 1 || links[0].Type != "SPOTIFY" {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+}
+
+func TestGetExternalLinksVerifiesServerCertByDefault(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"external-links":[]}}`))
+	}))
+	defer server.Close()
+
+	// InsecureSkipVerify left at its zero value (false): the test server's
+	// cert isn't signed by a known CA, so the request should fail rather
+	// than silently trust it.
+	config := configuration{MusicURL: server.URL + "/music/%s"}
+	musicClient, err := buildMusicHTTPClient(config)
+	if err != nil {
+		t.Fatalf("buildMusicHTTPClient: %v", err)
+	}
+	a := &app{config: config, musicClient: musicClient}
+
+	if _, err := a.getExternalLinks(context.Background(), "rec1"); err == nil {
+		t.Fatal("expected a certificate verification error, got nil")
+	}
+}
+
+func TestGetExternalLinksMutualTLS(t *testing.T) {
+	certPEM, keyPEM := generateSelfSignedCert(t)
+
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(certPEM)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"external-links":[]}}`))
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  certPool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	certFile := writePEMFile(t, dir, "client.crt", certPEM)
+	keyFile := writePEMFile(t, dir, "client.key", keyPEM)
+
+	config := configuration{
+		MusicURL:           server.URL + "/music/%s",
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+		InsecureSkipVerify: true, // the test cert isn't signed by a known CA
+	}
+	musicClient, err := buildMusicHTTPClient(config)
+	if err != nil {
+		t.Fatalf("buildMusicHTTPClient: %v", err)
+	}
+	a := &app{config: config, musicClient: musicClient}
+
+	if _, err := a.getExternalLinks(context.Background(), "rec1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBuildMusicHTTPClientWithoutCerts(t *testing.T) {
+	client, err := buildMusicHTTPClient(configuration{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected *http.Transport, got %T", client.Transport)
+	}
+	if len(transport.TLSClientConfig.Certificates) != 0 {
+		t.Fatal("expected no client certificates when CertFile/KeyFile are unset")
+	}
+}
+
+func generateSelfSignedCert(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+func writePEMFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/zmb3/spotify"
+)
+
+// trackFeatures is the provider-agnostic feature set getMood works from.
+// Spotify's audio-features/analysis endpoints are the richest source we
+// have, so the fields below are modelled on those, with other providers
+// filling in what they can and leaving the rest at their zero value.
+// Duration and Segments back the per-track contribution to the episode
+// mood timeline; providers with no section-level data simply leave
+// Segments nil.
+type trackFeatures struct {
+	Valence          float32
+	Energy           float32
+	Danceability     float32
+	Liveness         float32
+	Loudness         float32
+	Tempo            float32
+	TempoConfidence  float32
+	Acousticness     float32
+	Instrumentalness float32
+	Speechiness      float32
+	Key              int
+	Mode             int
+	Duration         float32
+	Segments         []segmentMood
+}
+
+// moodProvider looks up trackFeatures for a single external link. Spotify
+// links are handled directly by getMoodForEpisode so it can keep batching
+// requests across the whole episode; moodProvider exists for the other
+// link types in musicData.ExternalLinks (APPLE_MUSIC, DEEZER, MUSICBRAINZ,
+// ...) that used to be silently dropped.
+type moodProvider interface {
+	Lookup(ctx context.Context, link externalLink) (trackFeatures, error)
+}
+
+func featuresFromSpotify(t spotifyTrackData) trackFeatures {
+	track := t.Analysis.Track
+
+	segments := make([]segmentMood, len(t.Analysis.Sections))
+	for i, section := range t.Analysis.Sections {
+		arousal := sectionArousal(section)
+		segments[i] = segmentMood{
+			StartSeconds:    float32(section.Start),
+			DurationSeconds: float32(section.Duration),
+			Arousal:         arousal,
+			Label:           moodLabel(t.Features.Valence, arousal),
+		}
+	}
+
+	return trackFeatures{
+		Valence:          t.Features.Valence,
+		Energy:           t.Features.Energy,
+		Danceability:     t.Features.Danceability,
+		Liveness:         t.Features.Liveness,
+		Loudness:         t.Features.Loudness,
+		Tempo:            float32(track.Tempo),
+		TempoConfidence:  float32(track.TempoConfidence),
+		Acousticness:     t.Features.Acousticness,
+		Instrumentalness: t.Features.Instrumentalness,
+		Speechiness:      t.Features.Speechiness,
+		Key:              t.Features.Key,
+		Mode:             t.Features.Mode,
+		Duration:         float32(track.Duration),
+		Segments:         segments,
+	}
+}
+
+// sectionArousal approximates a mood-timeline arousal value for one
+// analysis section from its tempo and loudness, the same two signals the
+// original single-figure chill factor was built from. Spotify's analysis
+// doesn't report valence per section, so segmentMood.Label is classified
+// against the track's overall valence instead.
+func sectionArousal(section spotify.Section) float32 {
+	return (float32(section.Tempo) / 120) * ((float32(section.Loudness) + 30) / 30)
+}
+
+// averageTrackFeatures merges the features reported by multiple providers
+// for the same record into one, so a record with both a Spotify and a
+// MusicBrainz link only contributes a single data point to the episode mood.
+func averageTrackFeatures(features []trackFeatures) trackFeatures {
+	var avg trackFeatures
+	var keys, modes []int
+	var durationCount float32
+	for _, f := range features {
+		avg.Valence += f.Valence
+		avg.Energy += f.Energy
+		avg.Danceability += f.Danceability
+		avg.Liveness += f.Liveness
+		avg.Loudness += f.Loudness
+		avg.Tempo += f.Tempo
+		avg.TempoConfidence += f.TempoConfidence
+		avg.Acousticness += f.Acousticness
+		avg.Instrumentalness += f.Instrumentalness
+		avg.Speechiness += f.Speechiness
+		// Providers like MusicBrainz have no duration of their own and
+		// leave it at zero; averaging those in would understate the
+		// record's real length and skew the episode mood timeline.
+		if f.Duration > 0 {
+			avg.Duration += f.Duration
+			durationCount++
+		}
+		avg.Segments = append(avg.Segments, f.Segments...)
+		keys = append(keys, f.Key)
+		modes = append(modes, f.Mode)
+	}
+	n := float32(len(features))
+	avg.Valence /= n
+	avg.Energy /= n
+	avg.Danceability /= n
+	avg.Liveness /= n
+	avg.Loudness /= n
+	avg.Tempo /= n
+	avg.TempoConfidence /= n
+	avg.Acousticness /= n
+	avg.Instrumentalness /= n
+	avg.Speechiness /= n
+	if durationCount > 0 {
+		avg.Duration /= durationCount
+	}
+	avg.Key = dominantInt(keys)
+	avg.Mode = dominantInt(modes)
+	return avg
+}
+
+// buildProviders constructs the moodProviders enabled for this run. Only
+// link types named in config.Providers are dispatched; anything else is
+// logged and skipped rather than failing the whole episode.
+func buildProviders(config configuration, httpClient *http.Client) map[string]moodProvider {
+	providers := make(map[string]moodProvider)
+	for _, name := range config.Providers {
+		switch name {
+		case "MUSICBRAINZ":
+			providers["MUSICBRAINZ"] = &musicBrainzProvider{
+				httpClient:   httpClient,
+				highLevelURL: config.AcousticBrainzHighLevelURL,
+				lowLevelURL:  config.AcousticBrainzLowLevelURL,
+			}
+		}
+	}
+	return providers
+}
+
+// musicBrainzProvider derives trackFeatures from AcousticBrainz, which
+// publishes open, license-free high- and low-level audio analysis keyed by
+// MusicBrainz ID (MBID) - no OAuth required.
+type musicBrainzProvider struct {
+	httpClient   *http.Client
+	highLevelURL string
+	lowLevelURL  string
+}
+
+type acousticBrainzHighLevel struct {
+	HighLevel struct {
+		Danceability struct {
+			All map[string]float64 `json:"all"`
+		} `json:"danceability"`
+		MoodHappy struct {
+			All map[string]float64 `json:"all"`
+		} `json:"mood_happy"`
+		MoodAggressive struct {
+			All map[string]float64 `json:"all"`
+		} `json:"mood_aggressive"`
+		MoodAcoustic struct {
+			All map[string]float64 `json:"all"`
+		} `json:"mood_acoustic"`
+		VoiceInstrumental struct {
+			All map[string]float64 `json:"all"`
+		} `json:"voice_instrumental"`
+	} `json:"highlevel"`
+}
+
+type acousticBrainzLowLevel struct {
+	Rhythm struct {
+		BPM float64 `json:"bpm"`
+	} `json:"rhythm"`
+	LowLevel struct {
+		AverageLoudness float64 `json:"average_loudness"`
+	} `json:"lowlevel"`
+	Tonal struct {
+		KeyKey   string `json:"key_key"`
+		KeyScale string `json:"key_scale"`
+	} `json:"tonal"`
+}
+
+// pitchClasses maps AcousticBrainz's note-name keys onto Spotify's 0 (C)
+// to 11 (B) pitch-class integers, so dominantInt can compare keys across
+// providers.
+var pitchClasses = map[string]int{
+	"C": 0, "C#": 1, "Db": 1, "D": 2, "D#": 3, "Eb": 3, "E": 4, "F": 5,
+	"F#": 6, "Gb": 6, "G": 7, "G#": 8, "Ab": 8, "A": 9, "A#": 10, "Bb": 10, "B": 11,
+}
+
+// Lookup treats link.Value as the release/recording MBID. AcousticBrainz
+// has no direct equivalent of Spotify's "liveness" or "speechiness", so
+// those fields are left at their zero value for this provider, and it has
+// no section-level data to build a mood timeline from.
+func (p *musicBrainzProvider) Lookup(ctx context.Context, link externalLink) (trackFeatures, error) {
+	highLevel, err := p.fetchHighLevel(ctx, link.Value)
+	if err != nil {
+		return trackFeatures{}, err
+	}
+	lowLevel, err := p.fetchLowLevel(ctx, link.Value)
+	if err != nil {
+		return trackFeatures{}, err
+	}
+
+	// AcousticBrainz reports average_loudness normalised to 0-1; rescale to
+	// the roughly -30..0 dB range the rest of the pipeline expects.
+	loudness := float32(lowLevel.LowLevel.AverageLoudness-1) * 30
+
+	mode := 0
+	if lowLevel.Tonal.KeyScale == "major" {
+		mode = 1
+	}
+
+	return trackFeatures{
+		Valence:          float32(highLevel.HighLevel.MoodHappy.All["happy"]),
+		Energy:           float32(highLevel.HighLevel.MoodAggressive.All["aggressive"]),
+		Danceability:     float32(highLevel.HighLevel.Danceability.All["danceable"]),
+		Acousticness:     float32(highLevel.HighLevel.MoodAcoustic.All["acoustic"]),
+		Instrumentalness: float32(highLevel.HighLevel.VoiceInstrumental.All["instrumental"]),
+		Loudness:         loudness,
+		Tempo:            float32(lowLevel.Rhythm.BPM),
+		Key:              pitchClasses[lowLevel.Tonal.KeyKey],
+		Mode:             mode,
+	}, nil
+}
+
+func (p *musicBrainzProvider) fetchHighLevel(ctx context.Context, mbid string) (acousticBrainzHighLevel, error) {
+	var result acousticBrainzHighLevel
+	body, err := p.get(ctx, fmt.Sprintf(p.highLevelURL, mbid))
+	if err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return result, fmt.Errorf("failed to parse AcousticBrainz high-level response: %w", err)
+	}
+	return result, nil
+}
+
+func (p *musicBrainzProvider) fetchLowLevel(ctx context.Context, mbid string) (acousticBrainzLowLevel, error) {
+	var result acousticBrainzLowLevel
+	body, err := p.get(ctx, fmt.Sprintf(p.lowLevelURL, mbid))
+	if err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return result, fmt.Errorf("failed to parse AcousticBrainz low-level response: %w", err)
+	}
+	return result, nil
+}
+
+func (p *musicBrainzProvider) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query AcousticBrainz: %w", err)
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
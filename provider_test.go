@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAverageTrackFeaturesSkipsZeroDurationProviders(t *testing.T) {
+	// A record with both a Spotify link and a MusicBrainz link: the
+	// zero-duration MusicBrainz entry shouldn't drag the average down,
+	// since that would understate the record's real length.
+	features := []trackFeatures{
+		{Duration: 180, Valence: 0.8},
+		{Duration: 0, Valence: 0.4}, // e.g. a MusicBrainz lookup, which has no duration
+	}
+
+	avg := averageTrackFeatures(features)
+
+	if got, want := avg.Duration, float32(180); got != want {
+		t.Fatalf("Duration = %v, want %v", got, want)
+	}
+	if got, want := avg.Valence, float32(0.6); got != want {
+		t.Fatalf("Valence = %v, want %v", got, want)
+	}
+}
+
+func TestAverageTrackFeaturesMusicBrainzOnlyRecord(t *testing.T) {
+	// A record whose only external link is non-Spotify (e.g. MUSICBRAINZ)
+	// produces a single trackFeatures entry with Duration left at zero.
+	features := []trackFeatures{
+		{Duration: 0, Valence: 0.7, Tempo: 120},
+	}
+
+	avg := averageTrackFeatures(features)
+
+	if got, want := avg.Duration, float32(0); got != want {
+		t.Fatalf("Duration = %v, want %v", got, want)
+	}
+	if got, want := avg.Tempo, float32(120); got != want {
+		t.Fatalf("Tempo = %v, want %v", got, want)
+	}
+}
+
+func TestBuildProvidersEnablesOnlyConfiguredNames(t *testing.T) {
+	config := configuration{
+		Providers:                  []string{"MUSICBRAINZ"},
+		AcousticBrainzHighLevelURL: "http://example.com/high/%s",
+		AcousticBrainzLowLevelURL:  "http://example.com/low/%s",
+	}
+
+	providers := buildProviders(config, http.DefaultClient)
+
+	if len(providers) != 1 {
+		t.Fatalf("got %d providers, want 1", len(providers))
+	}
+	if _, ok := providers["MUSICBRAINZ"]; !ok {
+		t.Fatalf("providers = %v, want MUSICBRAINZ present", providers)
+	}
+}
+
+func TestBuildProvidersSkipsUnknownNames(t *testing.T) {
+	config := configuration{Providers: []string{"APPLE_MUSIC"}}
+
+	providers := buildProviders(config, http.DefaultClient)
+
+	if len(providers) != 0 {
+		t.Fatalf("got %d providers, want 0", len(providers))
+	}
+}
+
+func TestMusicBrainzProviderLookupParsesResponses(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/high/abc-123", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"highlevel": {
+				"danceability": {"all": {"danceable": 0.8}},
+				"mood_happy": {"all": {"happy": 0.6}},
+				"mood_aggressive": {"all": {"aggressive": 0.3}},
+				"mood_acoustic": {"all": {"acoustic": 0.1}},
+				"voice_instrumental": {"all": {"instrumental": 0.9}}
+			}
+		}`))
+	})
+	mux.HandleFunc("/low/abc-123", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"rhythm": {"bpm": 128},
+			"lowlevel": {"average_loudness": 0.9},
+			"tonal": {"key_key": "G#", "key_scale": "major"}
+		}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider := &musicBrainzProvider{
+		httpClient:   server.Client(),
+		highLevelURL: server.URL + "/high/%s",
+		lowLevelURL:  server.URL + "/low/%s",
+	}
+
+	features, err := provider.Lookup(context.Background(), externalLink{Value: "abc-123"})
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	if got, want := features.Valence, float32(0.6); got != want {
+		t.Fatalf("Valence = %v, want %v", got, want)
+	}
+	if got, want := features.Energy, float32(0.3); got != want {
+		t.Fatalf("Energy = %v, want %v", got, want)
+	}
+	if got, want := features.Danceability, float32(0.8); got != want {
+		t.Fatalf("Danceability = %v, want %v", got, want)
+	}
+	if got, want := features.Acousticness, float32(0.1); got != want {
+		t.Fatalf("Acousticness = %v, want %v", got, want)
+	}
+	if got, want := features.Instrumentalness, float32(0.9); got != want {
+		t.Fatalf("Instrumentalness = %v, want %v", got, want)
+	}
+	if got, want := features.Tempo, float32(128); got != want {
+		t.Fatalf("Tempo = %v, want %v", got, want)
+	}
+	if got, want := features.Key, pitchClasses["G#"]; got != want {
+		t.Fatalf("Key = %v, want %v", got, want)
+	}
+	if got, want := features.Mode, 1; got != want {
+		t.Fatalf("Mode = %v, want %v", got, want)
+	}
+	if got, want := features.Loudness, float32(lowLevelLoudnessWant); got != want {
+		t.Fatalf("Loudness = %v, want %v", got, want)
+	}
+}
+
+// lowLevelLoudnessWant mirrors the -30..0 dB rescale applied to
+// AcousticBrainz's 0-1 average_loudness in musicBrainzProvider.Lookup.
+const lowLevelLoudnessWant = (0.9 - 1) * 30
+
+func TestMusicBrainzProviderLookupMinorKey(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/high/xyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"highlevel": {}}`))
+	})
+	mux.HandleFunc("/low/xyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tonal": {"key_key": "C", "key_scale": "minor"}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider := &musicBrainzProvider{
+		httpClient:   server.Client(),
+		highLevelURL: server.URL + "/high/%s",
+		lowLevelURL:  server.URL + "/low/%s",
+	}
+
+	features, err := provider.Lookup(context.Background(), externalLink{Value: "xyz"})
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got, want := features.Mode, 0; got != want {
+		t.Fatalf("Mode = %v, want %v", got, want)
+	}
+	if got, want := features.Key, pitchClasses["C"]; got != want {
+		t.Fatalf("Key = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// spotifyAudioFeaturesBatchSize is the largest number of track IDs the
+	// audio-features endpoint accepts in a single call.
+	spotifyAudioFeaturesBatchSize = 100
+
+	// spotifyAnalysisConcurrency bounds how many audio-analysis calls (one
+	// per track, no batch endpoint exists) are in flight at once.
+	spotifyAnalysisConcurrency = 8
+
+	retryTransportMaxRetries = 5
+	retryTransportBaseDelay  = time.Second
+)
+
+// retryTransport wraps an http.RoundTripper and retries requests that come
+// back 429, honouring Spotify's Retry-After header when present and falling
+// back to exponential backoff otherwise.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.baseDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		wait := delay
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			if secs, perr := strconv.Atoi(retryAfter); perr == nil {
+				wait = time.Duration(secs) * time.Second
+			}
+		}
+		resp.Body.Close()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func chunkTrackIDs(ids []spotify.ID, size int) [][]spotify.ID {
+	var chunks [][]spotify.ID
+	for size < len(ids) {
+		ids, chunks = ids[size:], append(chunks, ids[:size:size])
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// getSpotifyData fetches audio features and analysis for trackIDs, checking
+// the cache first. Audio features are fetched in batches of up to
+// spotifyAudioFeaturesBatchSize IDs per call; audio analysis has no batch
+// endpoint, so those calls fan out across a bounded worker pool instead.
+func (a *app) getSpotifyData(ctx context.Context, trackIDs []spotify.ID) ([]spotifyTrackData, error) {
+	features := make(map[spotify.ID]spotify.AudioFeatures, len(trackIDs))
+	analyses := make(map[spotify.ID]spotify.AudioAnalysis, len(trackIDs))
+
+	var featuresMissing []spotify.ID
+	for _, trackID := range trackIDs {
+		var f spotify.AudioFeatures
+		if found, err := getJSON(ctx, a.cache, audioFeaturesCacheKey(trackID), &f); err == nil && found {
+			features[trackID] = f
+		} else {
+			featuresMissing = append(featuresMissing, trackID)
+		}
+	}
+
+	for _, chunk := range chunkTrackIDs(featuresMissing, spotifyAudioFeaturesBatchSize) {
+		fetched, err := a.spotifyClient.GetAudioFeatures(chunk...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get audio features: %w", err)
+		}
+		for i, f := range fetched {
+			if f == nil {
+				// Spotify returns a nil entry for IDs it couldn't resolve.
+				continue
+			}
+			features[chunk[i]] = *f
+			if err := setJSON(ctx, a.cache, audioFeaturesCacheKey(chunk[i]), audioFeaturesTTL, *f); err != nil {
+				log.Printf("failed to cache audio features for %s: %v", chunk[i], err)
+			}
+		}
+	}
+
+	var analysisMissing []spotify.ID
+	for _, trackID := range trackIDs {
+		var an spotify.AudioAnalysis
+		if found, err := getJSON(ctx, a.cache, audioAnalysisCacheKey(trackID), &an); err == nil && found {
+			analyses[trackID] = an
+		} else {
+			analysisMissing = append(analysisMissing, trackID)
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(spotifyAnalysisConcurrency)
+	var mu sync.Mutex
+	for _, trackID := range analysisMissing {
+		trackID := trackID
+		g.Go(func() error {
+			analysisPointer, err := a.spotifyClient.GetAudioAnalysis(trackID)
+			if err != nil {
+				return fmt.Errorf("failed to get audio analysis for %s: %w", trackID, err)
+			}
+
+			mu.Lock()
+			analyses[trackID] = *analysisPointer
+			mu.Unlock()
+
+			if err := setJSON(gctx, a.cache, audioAnalysisCacheKey(trackID), audioAnalysisTTL, *analysisPointer); err != nil {
+				log.Printf("failed to cache audio analysis for %s: %v", trackID, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var tracks []spotifyTrackData
+	for _, trackID := range trackIDs {
+		f, ok := features[trackID]
+		if !ok {
+			return nil, fmt.Errorf("no audio features returned for %s", trackID)
+		}
+		an, ok := analyses[trackID]
+		if !ok {
+			return nil, fmt.Errorf("no audio analysis returned for %s", trackID)
+		}
+		tracks = append(tracks, spotifyTrackData{Features: f, Analysis: an})
+	}
+
+	return tracks, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+func TestChunkTrackIDs(t *testing.T) {
+	ids := func(n int) []spotify.ID {
+		out := make([]spotify.ID, n)
+		for i := range out {
+			out[i] = spotify.ID(string(rune('a' + i)))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		n         int
+		size      int
+		wantSizes []int
+	}{
+		{"empty", 0, 100, nil},
+		{"under one batch", 3, 100, []int{3}},
+		{"exactly one batch", 100, 100, []int{100}},
+		{"spills into a second batch", 150, 100, []int{100, 50}},
+		{"several full batches", 250, 100, []int{100, 100, 50}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkTrackIDs(ids(tt.n), tt.size)
+			if len(chunks) != len(tt.wantSizes) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(tt.wantSizes))
+			}
+			for i, want := range tt.wantSizes {
+				if len(chunks[i]) != want {
+					t.Fatalf("chunk %d has %d IDs, want %d", i, len(chunks[i]), want)
+				}
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRetryTransportRetriesOn429WithRetryAfter(t *testing.T) {
+	attempts := 0
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": []string{"0"}},
+				Body:       http.NoBody,
+			}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	transport := &retryTransport{base: base, maxRetries: 3, baseDelay: time.Millisecond}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestRetryTransportGivesUpAfterMaxRetries(t *testing.T) {
+	attempts := 0
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Body: http.NoBody}, nil
+	})
+
+	transport := &retryTransport{base: base, maxRetries: 2, baseDelay: time.Millisecond}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if attempts != 3 { // the initial attempt plus maxRetries retries
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestRetryTransportPassesThroughNon429(t *testing.T) {
+	attempts := 0
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	transport := &retryTransport{base: base, maxRetries: 3, baseDelay: time.Millisecond}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+}